@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"github.com/gravitational/teleport/revocation"
+)
+
+// RevokeUserCert revokes a previously issued user certificate identified by
+// serial and keyID. The revocation is persisted under
+// revocation.DefaultKey, so any srv.Server configured with
+// KRLConfig{Backend: srv.DefaultKRLBackendKey} picks it up on its next
+// reload and refuses the certificate. tool/tctl/common.RevokeCertCommand
+// wraps this so an operator can revoke a cert from the command line rather
+// than writing Go against AuthServer directly.
+//
+// This depends on the revocation package rather than srv directly: srv's
+// test binary (package srv + srv_test.go) needs to import auth to mint
+// certificates through AuthServer, so auth importing srv back would be a
+// cycle. revocation holds the shared storage format both sides need
+// instead.
+func (a *AuthServer) RevokeUserCert(serial uint64, keyID string) error {
+	return revocation.Revoke(a.bk, revocation.DefaultKey, serial, keyID)
+}
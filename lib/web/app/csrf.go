@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// csrfCookieName is the double-submit cookie set on the GET response and
+// echoed back by the caller in the X-CSRF-Token header on the POST.
+//
+// The __Host- prefix instructs the browser to refuse the cookie unless it
+// is set over HTTPS, without a Domain attribute, and with Path=/, which
+// rules out it being clobbered by a sibling subdomain.
+const csrfCookieName = "__Host-teleport-csrf"
+
+// csrfHeader is the header the caller must echo the csrfCookieName value
+// back in on the POST.
+const csrfHeader = "X-CSRF-Token"
+
+// csrfTokenTTL is the MaxAge of the __Host-teleport-csrf cookie set on the
+// GET leg of /x-teleport-auth. The token in it is minted by a stateCache, so
+// server-side it stays valid for stateTTL (state.go), which has the same
+// value.
+const csrfTokenTTL = 5 * time.Minute
+
+// checkCSRF validates that r carries a csrfHeader value matching the
+// csrfCookieName cookie set earlier in the flow, and that tokens still
+// recognizes it as an unexpired, unused token minted by tokens.new.
+func checkCSRF(r *http.Request, tokens *stateCache) error {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil {
+		return trace.AccessDenied("missing CSRF cookie")
+	}
+
+	header := r.Header.Get(csrfHeader)
+	if header == "" {
+		return trace.AccessDenied("missing %v header", csrfHeader)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return trace.AccessDenied("CSRF token mismatch")
+	}
+
+	if !tokens.consume(cookie.Value) {
+		return trace.AccessDenied("CSRF token expired or already used")
+	}
+
+	return nil
+}
+
+// checkOrigin validates that the request's Origin (falling back to
+// Referer) header names publicAddr, rejecting cross-origin POSTs outright.
+func checkOrigin(r *http.Request, publicAddr string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return trace.AccessDenied("missing Origin/Referer header")
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if u.Host != publicAddr {
+		return trace.AccessDenied("origin %v does not match proxy address %v", u.Host, publicAddr)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newCSRFRequest(token, header string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "https://app.example.com/x-teleport-auth", nil)
+	if token != "" {
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: token})
+	}
+	if header != "" {
+		r.Header.Set(csrfHeader, header)
+	}
+	return r
+}
+
+func TestCheckCSRFMissingCookie(t *testing.T) {
+	tokens := newStateCache()
+	r := newCSRFRequest("", "whatever")
+	if err := checkCSRF(r, tokens); err == nil {
+		t.Fatal("checkCSRF with no cookie succeeded, want error")
+	}
+}
+
+func TestCheckCSRFMissingHeader(t *testing.T) {
+	tokens := newStateCache()
+	token := tokens.new()
+	r := newCSRFRequest(token, "")
+	if err := checkCSRF(r, tokens); err == nil {
+		t.Fatal("checkCSRF with no header succeeded, want error")
+	}
+}
+
+func TestCheckCSRFMismatch(t *testing.T) {
+	tokens := newStateCache()
+	token := tokens.new()
+	r := newCSRFRequest(token, "not-the-token")
+	if err := checkCSRF(r, tokens); err == nil {
+		t.Fatal("checkCSRF with mismatched header succeeded, want error")
+	}
+}
+
+func TestCheckCSRFUnknownToken(t *testing.T) {
+	tokens := newStateCache()
+	r := newCSRFRequest("never-minted", "never-minted")
+	if err := checkCSRF(r, tokens); err == nil {
+		t.Fatal("checkCSRF with a token tokens never minted succeeded, want error")
+	}
+}
+
+func TestCheckCSRFReplay(t *testing.T) {
+	tokens := newStateCache()
+	token := tokens.new()
+	r := newCSRFRequest(token, token)
+
+	if err := checkCSRF(r, tokens); err != nil {
+		t.Fatalf("first use of a valid token failed: %v", err)
+	}
+
+	r2 := newCSRFRequest(token, token)
+	if err := checkCSRF(r2, tokens); err == nil {
+		t.Fatal("replaying a consumed token succeeded, want error")
+	}
+}
+
+func TestCheckOriginMismatch(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "https://app.example.com/x-teleport-auth", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	if err := checkOrigin(r, "app.example.com"); err == nil {
+		t.Fatal("checkOrigin with a mismatched Origin succeeded, want error")
+	}
+}
+
+func TestCheckOriginMissing(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "https://app.example.com/x-teleport-auth", nil)
+	if err := checkOrigin(r, "app.example.com"); err == nil {
+		t.Fatal("checkOrigin with no Origin/Referer succeeded, want error")
+	}
+}
+
+func TestCheckOriginMatch(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "https://app.example.com/x-teleport-auth", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	if err := checkOrigin(r, "app.example.com"); err != nil {
+		t.Fatalf("checkOrigin with a matching Origin failed: %v", err)
+	}
+}
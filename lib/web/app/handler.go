@@ -18,6 +18,7 @@ limitations under the License.
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -26,7 +27,6 @@ import (
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/auth"
-	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/reversetunnel"
 	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/utils"
@@ -39,6 +39,40 @@ import (
 type HandlerConfig struct {
 	AuthClient  auth.ClientI
 	ProxyClient reversetunnel.Server
+
+	// AuthProvider, if set, is used to authenticate callers via an
+	// external OIDC/OAuth2 identity provider instead of requiring them to
+	// already hold a session cookie.
+	AuthProvider AuthProvider
+
+	// PublicAddr is the proxy's public facing address. It is used to
+	// validate the Origin/Referer of POSTs to /x-teleport-auth.
+	PublicAddr string
+
+	// SessionStore persists sessions so they survive across app proxy
+	// replicas. Defaults to an in-process map, which only works for a
+	// single instance. Takes precedence over SessionBackend/
+	// SessionEncryptionKey below.
+	SessionStore SessionStore
+
+	// SessionBackend, if true and SessionStore is unset, persists sessions
+	// through the auth server's backend (see backendSessionStore) instead
+	// of an in-process map, so multiple app proxy replicas see the same
+	// logins.
+	SessionBackend bool
+
+	// SessionEncryptionKey is the AEAD key backendSessionStore encrypts
+	// sessions with at rest when SessionBackend is set. It must be 16, 24,
+	// or 32 bytes (AES-128/192/256).
+	//
+	// This is not derived from the auth server automatically: no API for
+	// fetching a per-cluster key is available to this package in this
+	// tree, so the caller must obtain and supply it.
+	SessionEncryptionKey []byte
+
+	// ProxyConfig controls how internal applications are reached when
+	// they sit behind an outbound HTTP(S) or SOCKS5 proxy.
+	ProxyConfig ProxyConfig
 }
 
 func (c *HandlerConfig) Check() error {
@@ -57,6 +91,26 @@ type Handler struct {
 	log *logrus.Entry
 
 	sessions *sessionCache
+
+	// oauthState tracks the state parameter for in-flight logins against
+	// c.AuthProvider so the callback can be matched back to the request
+	// that started it.
+	oauthState *stateCache
+
+	// csrfTokens tracks CSRF tokens minted for the GET leg of
+	// /x-teleport-auth so checkCSRF can enforce that the POST leg's token
+	// is both unexpired and single-use.
+	csrfTokens *stateCache
+
+	// apps is a watch-driven index of every application visible to this
+	// proxy, used by IsApp to avoid looping over every cluster on each
+	// request.
+	apps *AppRegistry
+
+	// cancel stops the watchers behind apps. Close calls it so a Handler
+	// that's being torn down doesn't leak its watcher goroutines/watch
+	// connections forever.
+	cancel context.CancelFunc
 }
 
 func NewHandler(config HandlerConfig) (*Handler, error) {
@@ -64,11 +118,44 @@ func NewHandler(config HandlerConfig) (*Handler, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	store := config.SessionStore
+	if store == nil && config.SessionBackend {
+		backendStore, err := newBackendSessionStore(backendSessionStoreConfig{
+			AuthClient:    config.AuthClient,
+			EncryptionKey: config.SessionEncryptionKey,
+		})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		store = backendStore
+	}
+	if store == nil {
+		store = newMemorySessionStore()
+	}
+
+	// AppRegistry is built before sessionCache because sessionCache uses it
+	// to re-resolve a session's application after reading the session back
+	// from a SessionStore that can't round-trip a live services.Server.
+	//
+	// ctx is owned by this Handler: it's canceled from Close so apps' site
+	// watchers are torn down instead of running for the life of the process.
+	ctx, cancel := context.WithCancel(context.Background())
+	apps, err := NewAppRegistry(ctx, config.ProxyClient)
+	if err != nil {
+		cancel()
+		return nil, trace.Wrap(err)
+	}
+
 	sessionCache, err := newSessionCache(sessionCacheConfig{
-		AuthClient:  config.AuthClient,
-		ProxyClient: config.ProxyClient,
+		AuthClient:   config.AuthClient,
+		ProxyClient:  config.ProxyClient,
+		Store:        store,
+		ProxyConfig:  config.ProxyConfig,
+		Apps:         apps,
+		AuthProvider: config.AuthProvider,
 	})
 	if err != nil {
+		cancel()
 		return nil, trace.Wrap(err)
 	}
 
@@ -77,25 +164,56 @@ func NewHandler(config HandlerConfig) (*Handler, error) {
 		log: logrus.WithFields(logrus.Fields{
 			trace.Component: teleport.ComponentAppProxy,
 		}),
-		sessions: sessionCache,
+		sessions:   sessionCache,
+		oauthState: newStateCache(),
+		csrfTokens: newStateCache(),
+		apps:       apps,
+		cancel:     cancel,
 	}, nil
 }
 
+// Close stops this Handler's app watchers. It does not close c.AuthClient
+// or c.ProxyClient, which it doesn't own.
+func (h *Handler) Close() error {
+	h.cancel()
+	return nil
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// If the target is an application but it hits the special "x-teleport-auth"
 	// endpoint, then perform redirect authentication logic.
-	if r.URL.Path == "/x-teleport-auth" {
+	switch r.URL.Path {
+	case "/x-teleport-auth":
 		if err := h.handleFragment(w, r); err != nil {
 			h.log.Warnf("Fragment authentication failed: %v.", err)
 			http.Error(w, "internal service error", 500)
 			return
 		}
+		return
+	case "/x-teleport-auth/login":
+		if err := h.handleOIDCLogin(w, r); err != nil {
+			h.log.Warnf("OIDC login failed: %v.", err)
+			http.Error(w, "internal service error", 500)
+			return
+		}
+		return
+	case "/x-teleport-auth/callback":
+		if err := h.handleOIDCCallback(w, r); err != nil {
+			h.log.Warnf("OIDC callback failed: %v.", err)
+			http.Error(w, "internal service error", 500)
+			return
+		}
+		return
 	}
 
 	// Authenticate request by looking for an existing session. If a session
 	// does not exist, redirect the caller to the login screen.
 	session, err := h.authenticate(r)
 	if err != nil {
+		if h.c.AuthProvider != nil {
+			http.Redirect(w, r, "/x-teleport-auth/login", http.StatusFound)
+			return
+		}
 		h.log.Warnf("Authentication failed: %v.", err)
 		http.Error(w, "internal service error", 500)
 		return
@@ -109,37 +227,77 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// TODO(russjones): This is potentially very costly due to looping over all
-// clusters if a local cache for each cluster does not exist. Verify this
-// with @fspmarshall.
-func (h *Handler) IsApp(r *http.Request) (services.Server, error) {
-	appName, err := extractAppName(r)
+// handleOIDCLogin redirects the caller to c.AuthProvider to begin an
+// external login, recording a state token so handleOIDCCallback can match
+// the response back to this request.
+func (h *Handler) handleOIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	if h.c.AuthProvider == nil {
+		return trace.BadParameter("no auth provider configured")
+	}
+
+	state := h.oauthState.new()
+	loginURL, err := h.c.AuthProvider.LoginURL(state)
 	if err != nil {
-		return nil, trace.Wrap(err)
+		return trace.Wrap(err)
 	}
 
-	// Loop over all clusters and applications within them looking for the
-	// application that was requested.
-	for _, remoteClient := range h.c.ProxyClient.GetSites() {
-		authClient, err := remoteClient.CachingAccessPoint()
-		if err != nil {
-			return nil, trace.Wrap(err)
-		}
+	http.Redirect(w, r, loginURL, http.StatusFound)
+	return nil
+}
 
-		apps, err := authClient.GetApps(r.Context(), defaults.Namespace)
-		if err != nil {
-			return nil, trace.Wrap(err)
-		}
+// handleOIDCCallback completes an external login, mints a Teleport session
+// for the resulting identity, and sets the session cookie directly rather
+// than handing the value to client-side JS.
+func (h *Handler) handleOIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	if h.c.AuthProvider == nil {
+		return trace.BadParameter("no auth provider configured")
+	}
 
-		for _, app := range apps {
-			if app.GetAppName() == appName {
-				return app, nil
-			}
-		}
+	state := r.URL.Query().Get("state")
+	if !h.oauthState.consume(state) {
+		return trace.AccessDenied("invalid or expired state parameter")
+	}
+
+	identity, err := h.c.AuthProvider.Exchange(r.Context(), state, r.URL.Query().Get("code"))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	app, err := h.IsApp(r)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	session, err := h.sessions.newSession(r.Context(), identity.Username, app, identity)
+	if err != nil {
+		return trace.Wrap(err)
+	}
 
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    session.cookieValue,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+	})
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// IsApp looks up the application named by r's host header in h.apps, an
+// index kept current by a watcher rather than by scanning every cluster's
+// applications on each call.
+func (h *Handler) IsApp(r *http.Request) (services.Server, error) {
+	appName, err := extractAppName(r)
+	if err != nil {
+		return nil, trace.Wrap(err)
 	}
 
-	return nil, trace.NotFound("app %v not found", appName)
+	_, app, err := h.apps.Lookup(appName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return app, nil
 }
 
 type fragmentRequest struct {
@@ -149,8 +307,24 @@ type fragmentRequest struct {
 func (h *Handler) handleFragment(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case http.MethodGet:
-		fmt.Fprintf(w, js)
+		token := h.csrfTokens.new()
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    token,
+			Path:     "/",
+			MaxAge:   int(csrfTokenTTL.Seconds()),
+			SameSite: http.SameSiteLaxMode,
+			Secure:   true,
+		})
+		fmt.Fprintf(w, js, token)
 	case http.MethodPost:
+		if err := checkOrigin(r, h.c.PublicAddr); err != nil {
+			return trace.Wrap(err)
+		}
+		if err := checkCSRF(r, h.csrfTokens); err != nil {
+			return trace.Wrap(err)
+		}
+
 		var req fragmentRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			return trace.Wrap(err)
@@ -164,8 +338,12 @@ func (h *Handler) handleFragment(w http.ResponseWriter, r *http.Request) error {
 		// TODO(russjones): Add additional cookie values here.
 		// Set the "Set-Cookie" header on the response.
 		http.SetCookie(w, &http.Cookie{
-			Name:  cookieName,
-			Value: req.CookieValue,
+			Name:     cookieName,
+			Value:    req.CookieValue,
+			Path:     "/",
+			SameSite: http.SameSiteLaxMode,
+			Secure:   true,
+			HttpOnly: true,
 		})
 	default:
 		return trace.BadParameter("unsupported method: %q", r.Method)
@@ -210,15 +388,15 @@ func (h *Handler) forward(w http.ResponseWriter, r *http.Request, s *session) er
 		return trace.Wrap(err)
 	}
 
-	var err error
-
-	//r.URL = testutils.ParseURI("http://localhost:8081")
-	//r.URL, err = url.Parse("http://localhost:8081")
 	r.URL, err = url.Parse("http://" + s.app.GetInternalAddr())
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
+	// s.fwd was built by the session cache with a transport honoring
+	// h.c.ProxyConfig, so this already goes through the configured
+	// HTTP(S)/SOCKS5 proxy, if any, for the application's internal
+	// address.
 	s.fwd.ServeHTTP(w, r)
 	return nil
 }
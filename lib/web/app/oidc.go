@@ -0,0 +1,201 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/trace"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// Identity is the result of a completed login with an AuthProvider: who the
+// caller is, which Teleport roles they mapped to, and the tokens needed to
+// keep the session alive without forcing the user through the browser
+// redirect again.
+type Identity struct {
+	// Username is the Teleport identity the caller authenticated as.
+	Username string
+
+	// Roles are the Teleport roles the provider's claims mapped to.
+	Roles []string
+
+	// IDToken is the provider-issued ID token for this login.
+	IDToken string
+
+	// RefreshToken, if the provider supports offline access, is used to
+	// silently renew IDToken once it expires.
+	RefreshToken string
+
+	// Expiry is when IDToken expires. A zero value means the token doesn't
+	// expire, or the provider didn't report an expiry.
+	Expiry time.Time
+}
+
+// AuthProvider is an external identity provider that the app proxy can
+// delegate authentication to before a session is minted for a caller.
+type AuthProvider interface {
+	// LoginURL returns the URL the caller should be redirected to begin
+	// authentication. state is opaque and is returned unmodified to the
+	// callback so the caller can be matched back to the request that
+	// started the login.
+	LoginURL(state string) (string, error)
+
+	// Exchange completes a callback, turning an authorization code into an
+	// Identity. state is the same value LoginURL was called with, so an
+	// implementation doing PKCE can recover the verifier it paired with it.
+	Exchange(ctx context.Context, state, code string) (*Identity, error)
+
+	// Refresh exchanges a refresh token for a new Identity without
+	// requiring the caller to be redirected through the provider again.
+	Refresh(ctx context.Context, refreshToken string) (*Identity, error)
+}
+
+// OIDCConfig configures an OIDC/OAuth2 AuthProvider.
+type OIDCConfig struct {
+	// IssuerURL is the OIDC provider's issuer, used to discover the
+	// authorization, token, and JWKS endpoints.
+	IssuerURL string
+
+	// ClientID and ClientSecret identify this app proxy to the provider.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the app proxy's own callback endpoint,
+	// "https://<app>/x-teleport-auth/callback".
+	RedirectURL string
+
+	// Scopes are the OAuth2 scopes requested in addition to "openid" and
+	// "offline_access".
+	Scopes []string
+
+	// RoleMapper maps the ID token's claims to Teleport roles.
+	RoleMapper func(claims map[string]interface{}) ([]string, error)
+}
+
+// oidcAuthProvider implements AuthProvider using the Authorization Code
+// flow with PKCE.
+type oidcAuthProvider struct {
+	cfg      OIDCConfig
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+
+	// pkceVerifiers holds the PKCE code verifier generated for each
+	// in-flight login, keyed by its state token, so Exchange can recover
+	// the one LoginURL paired with the challenge it sent.
+	pkceVerifiers *verifierCache
+}
+
+// NewOIDCAuthProvider discovers cfg.IssuerURL and returns an AuthProvider
+// backed by it.
+func NewOIDCAuthProvider(ctx context.Context, cfg OIDCConfig) (AuthProvider, error) {
+	if cfg.RoleMapper == nil {
+		return nil, trace.BadParameter("RoleMapper is required")
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &oidcAuthProvider{
+		cfg:      cfg,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess}, cfg.Scopes...),
+		},
+		pkceVerifiers: newVerifierCache(),
+	}, nil
+}
+
+// LoginURL implements AuthProvider. It generates a fresh PKCE code verifier
+// for this login, sending its S256 challenge to the provider and keeping
+// the verifier itself around (keyed by state) for Exchange to use.
+func (p *oidcAuthProvider) LoginURL(state string) (string, error) {
+	verifier := oauth2.GenerateVerifier()
+	p.pkceVerifiers.add(state, verifier)
+	return p.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange implements AuthProvider.
+func (p *oidcAuthProvider) Exchange(ctx context.Context, state, code string) (*Identity, error) {
+	verifier, ok := p.pkceVerifiers.consume(state)
+	if !ok {
+		return nil, trace.BadParameter("missing or expired PKCE verifier for state")
+	}
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return p.identityFromToken(ctx, token)
+}
+
+// Refresh implements AuthProvider.
+func (p *oidcAuthProvider) Refresh(ctx context.Context, refreshToken string) (*Identity, error) {
+	token, err := p.oauth2.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return p.identityFromToken(ctx, token)
+}
+
+// identityFromToken verifies the ID token embedded in token and maps its
+// claims to a Teleport Identity.
+func (p *oidcAuthProvider) identityFromToken(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, trace.BadParameter("token response is missing id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	username, _ := claims["email"].(string)
+	if username == "" {
+		return nil, trace.BadParameter("claims are missing an email claim")
+	}
+
+	roles, err := p.cfg.RoleMapper(claims)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &Identity{
+		Username:     username,
+		Roles:        roles,
+		IDToken:      rawIDToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}, nil
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/reversetunnel"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+
+	"github.com/sirupsen/logrus"
+)
+
+// watcherBackoff bounds how long AppRegistry waits between reconnect
+// attempts after a watcher drops.
+const (
+	watcherBackoffMin = time.Second
+	watcherBackoffMax = time.Minute
+)
+
+// appEntry is what AppRegistry indexes an application by name under.
+type appEntry struct {
+	clusterName string
+	server      services.Server
+}
+
+// AppRegistry maintains an appName -> (clusterName, services.Server) index
+// kept current by subscribing to services.Apps events, so Lookup never has
+// to loop over every cluster's applications the way Handler.IsApp used to.
+type AppRegistry struct {
+	log *logrus.Entry
+
+	proxyClient reversetunnel.Server
+
+	mu      sync.RWMutex
+	entries map[string]appEntry
+}
+
+// NewAppRegistry creates an AppRegistry and starts a watcher for the local
+// cluster plus every currently known trusted cluster. It blocks until every
+// site has completed (successfully or not) its first GetApps seed, so a
+// Lookup made right after NewAppRegistry returns sees every app that
+// existed at startup instead of racing the first watcher connection. Each
+// site's watcher keeps running, independently of that first seed's outcome,
+// until ctx is canceled.
+func NewAppRegistry(ctx context.Context, proxyClient reversetunnel.Server) (*AppRegistry, error) {
+	r := &AppRegistry{
+		log: logrus.WithFields(logrus.Fields{
+			trace.Component: teleport.ComponentAppProxy,
+		}),
+		proxyClient: proxyClient,
+		entries:     make(map[string]appEntry),
+	}
+
+	sites := proxyClient.GetSites()
+	var seeded sync.WaitGroup
+	seeded.Add(len(sites))
+	for _, site := range sites {
+		go r.watchSite(ctx, site, &seeded)
+	}
+	seeded.Wait()
+
+	return r, nil
+}
+
+// Lookup returns the cluster and services.Server for appName in O(1).
+func (r *AppRegistry) Lookup(appName string) (string, services.Server, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, ok := r.entries[appName]
+	if !ok {
+		return "", nil, trace.NotFound("app %v not found", appName)
+	}
+	return entry.clusterName, entry.server, nil
+}
+
+// watchSite seeds the index with a single GetApps call, then applies
+// OpPut/OpDelete events from site's watcher forever, reconnecting with
+// exponential backoff (and a full resync) whenever the watcher drops. A
+// run that returns without an error (its watcher closed cleanly) resets the
+// backoff, so the reconnect after it waits only watcherBackoffMin instead of
+// inheriting whatever backoff an earlier, unrelated failure streak left
+// behind. A run that ends in an error doubles the backoff however long it
+// ran.
+//
+// seeded is marked Done once, after this site's first seed attempt
+// (successful or not), so NewAppRegistry can block until every site has had
+// a chance to populate the index before handing out Lookups.
+func (r *AppRegistry) watchSite(ctx context.Context, site reversetunnel.RemoteSite, seeded *sync.WaitGroup) {
+	backoffTime := watcherBackoffMin
+
+	for {
+		err := r.runWatcher(ctx, site, seeded)
+		seeded = nil
+		if err != nil {
+			r.log.Warnf("App watcher for cluster %v failed: %v. Reconnecting in %v.", site.GetName(), err, backoffTime)
+		} else {
+			backoffTime = watcherBackoffMin
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoffTime):
+		}
+
+		backoffTime = nextWatcherBackoff(backoffTime, err)
+	}
+}
+
+// nextWatcherBackoff returns the backoff to use for the next reconnect
+// attempt after one that returned err: watcherBackoffMin on success, or
+// current doubled (capped at watcherBackoffMax) on failure.
+func nextWatcherBackoff(current time.Duration, err error) time.Duration {
+	if err == nil {
+		return watcherBackoffMin
+	}
+	next := current * 2
+	if next > watcherBackoffMax {
+		next = watcherBackoffMax
+	}
+	return next
+}
+
+// runWatcher performs one seed-then-watch cycle for site, returning when
+// the watcher closes or errors. If seeded is non-nil, it is marked Done
+// exactly once, right after the seed step settles, whether or not it
+// succeeded.
+func (r *AppRegistry) runWatcher(ctx context.Context, site reversetunnel.RemoteSite, seeded *sync.WaitGroup) error {
+	accessPoint, err := site.CachingAccessPoint()
+	if err != nil {
+		if seeded != nil {
+			seeded.Done()
+		}
+		return trace.Wrap(err)
+	}
+
+	err = r.resync(ctx, site.GetName(), accessPoint)
+	if seeded != nil {
+		seeded.Done()
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	watcher, err := accessPoint.NewWatcher(ctx, services.Watch{
+		Kinds: []services.WatchKind{{Kind: services.KindApp}},
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watcher.Done():
+			return trace.Wrap(watcher.Error())
+		case event := <-watcher.Events():
+			r.applyEvent(site.GetName(), event)
+		}
+	}
+}
+
+// resync replaces every entry for clusterName with a fresh GetApps seed.
+func (r *AppRegistry) resync(ctx context.Context, clusterName string, accessPoint auth.AccessPoint) error {
+	apps, err := accessPoint.GetApps(ctx, defaults.Namespace)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, entry := range r.entries {
+		if entry.clusterName == clusterName {
+			delete(r.entries, name)
+		}
+	}
+	for _, app := range apps {
+		r.entries[app.GetAppName()] = appEntry{clusterName: clusterName, server: app}
+	}
+
+	return nil
+}
+
+// appIdentity is the minimal surface applyEvent needs to remove an entry on
+// OpDelete. Delete events carry only resource identity, not a
+// fully-populated services.Server body, so the delete path can't require
+// the full services.Server interface that OpPut does.
+type appIdentity interface {
+	GetAppName() string
+}
+
+// applyEvent applies a single OpPut/OpDelete event to the index.
+func (r *AppRegistry) applyEvent(clusterName string, event services.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch event.Type {
+	case backend.OpPut:
+		app, ok := event.Resource.(services.Server)
+		if !ok {
+			return
+		}
+		r.entries[app.GetAppName()] = appEntry{clusterName: clusterName, server: app}
+	case backend.OpDelete:
+		app, ok := event.Resource.(appIdentity)
+		if !ok {
+			return
+		}
+		delete(r.entries, app.GetAppName())
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/services"
+)
+
+// fakeServer implements GetAppName, GetProxyURL, and GetInternalAddr: every
+// method this package actually calls on a services.Server, across
+// registry.go, session.go, and handler.go. It does not implement the rest
+// of the real interface (GetMetadata, CheckAndSetDefaults, etc.), which this
+// package never calls.
+type fakeServer struct {
+	appName string
+}
+
+func (f fakeServer) GetAppName() string      { return f.appName }
+func (f fakeServer) GetProxyURL() string     { return "" }
+func (f fakeServer) GetInternalAddr() string { return "" }
+
+// fakeDeletedApp implements only appIdentity, the way a real OpDelete
+// event's resource is expected to: just enough to identify which entry to
+// remove, not the full services.Server body a real delete event doesn't
+// carry.
+type fakeDeletedApp struct {
+	appName string
+}
+
+func (f fakeDeletedApp) GetAppName() string { return f.appName }
+
+// TestAppRegistryConverges checks that AppRegistry.Lookup reflects OpPut and
+// OpDelete events applied to it, the way a real site watcher would deliver
+// them. It exercises applyEvent/Lookup directly rather than a full
+// NewAppRegistry + watcher goroutine, since the auth.AccessPoint and
+// reversetunnel.RemoteSite interfaces that runWatcher needs aren't available
+// in this tree to fake safely.
+func TestAppRegistryConverges(t *testing.T) {
+	r := &AppRegistry{entries: make(map[string]appEntry)}
+
+	if _, _, err := r.Lookup("dashboard"); err == nil {
+		t.Fatal("Lookup on an empty registry succeeded, want NotFound")
+	}
+
+	r.applyEvent("cluster-a", services.Event{
+		Type:     backend.OpPut,
+		Resource: fakeServer{appName: "dashboard"},
+	})
+
+	cluster, app, err := r.Lookup("dashboard")
+	if err != nil {
+		t.Fatalf("Lookup after OpPut: %v", err)
+	}
+	if cluster != "cluster-a" {
+		t.Errorf("cluster = %q, want %q", cluster, "cluster-a")
+	}
+	if app.GetAppName() != "dashboard" {
+		t.Errorf("app.GetAppName() = %q, want %q", app.GetAppName(), "dashboard")
+	}
+
+	// A real OpDelete event's resource carries only identity, not a fully
+	// populated services.Server, so this deliberately isn't fakeServer.
+	r.applyEvent("cluster-a", services.Event{
+		Type:     backend.OpDelete,
+		Resource: fakeDeletedApp{appName: "dashboard"},
+	})
+
+	if _, _, err := r.Lookup("dashboard"); err == nil {
+		t.Fatal("Lookup after OpDelete succeeded, want NotFound")
+	}
+}
+
+// TestAppRegistryResyncReplacesOnlyOwnCluster checks that re-seeding one
+// cluster's entries doesn't disturb another cluster's.
+func TestAppRegistryResyncReplacesOnlyOwnCluster(t *testing.T) {
+	r := &AppRegistry{entries: make(map[string]appEntry)}
+
+	r.applyEvent("cluster-a", services.Event{Type: backend.OpPut, Resource: fakeServer{appName: "a-app"}})
+	r.applyEvent("cluster-b", services.Event{Type: backend.OpPut, Resource: fakeServer{appName: "b-app"}})
+
+	// Simulate what resync does after a fresh GetApps seed for cluster-a:
+	// drop every existing cluster-a entry, then re-add the seed.
+	for name, entry := range r.entries {
+		if entry.clusterName == "cluster-a" {
+			delete(r.entries, name)
+		}
+	}
+	r.entries["a-app-2"] = appEntry{clusterName: "cluster-a", server: fakeServer{appName: "a-app-2"}}
+
+	if _, _, err := r.Lookup("a-app"); err == nil {
+		t.Fatal("stale cluster-a entry survived resync")
+	}
+	if _, _, err := r.Lookup("a-app-2"); err != nil {
+		t.Fatalf("Lookup a-app-2 after resync: %v", err)
+	}
+	if _, _, err := r.Lookup("b-app"); err != nil {
+		t.Fatalf("cluster-b entry was disturbed by cluster-a's resync: %v", err)
+	}
+}
+
+// TestNextWatcherBackoff checks that a failed reconnect attempt doubles the
+// backoff up to watcherBackoffMax, and that a clean run resets it to
+// watcherBackoffMin regardless of how high a prior failure streak had
+// pushed it.
+func TestNextWatcherBackoff(t *testing.T) {
+	if next := nextWatcherBackoff(watcherBackoffMin, errors.New("watcher failed")); next != 2*watcherBackoffMin {
+		t.Errorf("nextWatcherBackoff(min, err) = %v, want %v", next, 2*watcherBackoffMin)
+	}
+
+	if next := nextWatcherBackoff(watcherBackoffMax, errors.New("watcher failed")); next != watcherBackoffMax {
+		t.Errorf("nextWatcherBackoff(max, err) = %v, want capped at %v", next, watcherBackoffMax)
+	}
+
+	if next := nextWatcherBackoff(watcherBackoffMax, nil); next != watcherBackoffMin {
+		t.Errorf("nextWatcherBackoff(max, nil) = %v, want reset to %v", next, watcherBackoffMin)
+	}
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/reversetunnel"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+
+	"github.com/vulcand/oxy/forward"
+)
+
+// cookieName is the cookie the caller must present on every request to an
+// application once they've authenticated.
+const cookieName = "__Host-teleport-session"
+
+// sessionTTL is how long a session remains valid for without being used.
+// authenticate/handleFragment extend it on every successful lookup.
+const sessionTTL = 12 * time.Hour
+
+// js is served from the GET leg of /x-teleport-auth. %q is filled in with
+// the CSRF token the POST leg must echo back in the X-CSRF-Token header.
+const js = `<script>
+(function() {
+    var csrfToken = %q;
+    var cookieValue = window.location.hash.slice(1);
+    fetch("/x-teleport-auth", {
+        method: "POST",
+        headers: {"Content-Type": "application/json", "X-CSRF-Token": csrfToken},
+        body: JSON.stringify({cookie_value: cookieValue}),
+    }).then(function() {
+        window.location.hash = "";
+        window.location.reload();
+    });
+})();
+</script>`
+
+// appAccessChecker decides whether a session's identity may reach a given
+// application. It is deliberately narrower than services.AccessChecker so
+// sessionCache doesn't need to depend on its full surface.
+type appAccessChecker interface {
+	CheckAccessToApp(app services.Server) error
+}
+
+// denyAllChecker is an appAccessChecker that never grants access. It is
+// the default for a session whose roles mapped to an empty set: a
+// RoleMapper returning zero roles means "this identity has no app
+// access", and must not be confused with "RBAC wasn't set up", which would
+// make it fail open into unrestricted access instead of fail closed.
+type denyAllChecker struct{}
+
+func (denyAllChecker) CheckAccessToApp(app services.Server) error {
+	return trace.AccessDenied("identity has no roles granting access to %v", app.GetAppName())
+}
+
+// buildAccessChecker fetches each of roleNames from authClient and
+// aggregates them into a services.RoleSet, which implements
+// appAccessChecker the same way a single role's CheckAccessToApp would.
+func buildAccessChecker(roleNames []string, authClient auth.ClientI) (appAccessChecker, error) {
+	roles := make([]services.Role, 0, len(roleNames))
+	for _, name := range roleNames {
+		role, err := authClient.GetRole(name)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		roles = append(roles, role)
+	}
+	return services.NewRoleSet(roles...), nil
+}
+
+// session is a single caller's authenticated access to a single
+// application: who they are, whether they may reach app, and the forwarder
+// that proxies their requests to it.
+type session struct {
+	// mu guards app, checker, and fwd against hydrate running concurrently
+	// on the same *session: a SessionStore backed by a shared cache (see
+	// backendSessionStore) can hand the same pointer to two requests for
+	// the same cookie at once, and without this lock both could run
+	// hydrate's nil-check-then-write at the same time and tear each
+	// other's writes to these interface values.
+	mu sync.Mutex
+
+	// cookieValue is the value of the cookie presented by the caller (and
+	// the key this session is stored under in sessionCache's SessionStore).
+	cookieValue string
+
+	// username is the identity this session was minted for.
+	username string
+
+	// app is the application this session grants access to. It is nil
+	// right after a SessionStore round trip (services.Server isn't JSON
+	// serializable in general); sessionCache.get re-resolves it from
+	// appName via the AppRegistry before handing the session back.
+	app services.Server
+
+	// appName is app.GetAppName(), kept around so a session read back from
+	// a SessionStore can re-resolve app.
+	appName string
+
+	// checker decides whether username may still reach app. Like fwd, it
+	// is rebuilt by sessionCache.get rather than serialized.
+	checker appAccessChecker
+
+	// fwd proxies requests to app.GetInternalAddr(), through whatever
+	// outbound proxy sessionCacheConfig.ProxyConfig configures. Rebuilt by
+	// sessionCache.get after a SessionStore round trip.
+	fwd *forward.Forwarder
+
+	// idToken, refreshToken, and expiry are set for sessions minted from an
+	// AuthProvider login. sessionCache.get uses them to silently refresh the
+	// session via AuthProvider.Refresh once expiry has passed, rather than
+	// forcing the caller back through the browser redirect.
+	idToken      string
+	refreshToken string
+	expiry       time.Time
+
+	// roles are the identity's roles, as mapped by RoleMapper during an
+	// AuthProvider login. hydrate uses them to build the real checker via
+	// buildAccessChecker; an empty roles list (RoleMapper mapped the
+	// identity to no roles, or the session wasn't minted from a login at
+	// all) denies access to every app rather than granting it.
+	roles []string
+}
+
+// sessionRecord is the JSON-serializable projection of a session used by
+// SessionStore implementations that persist outside this process (fwd and
+// checker can't cross that boundary, so they're rebuilt on read).
+type sessionRecord struct {
+	CookieValue  string    `json:"cookie_value"`
+	Username     string    `json:"username"`
+	AppName      string    `json:"app_name"`
+	IDToken      string    `json:"id_token,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+	Roles        []string  `json:"roles,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s *session) MarshalJSON() ([]byte, error) {
+	appName := s.appName
+	if s.app != nil {
+		appName = s.app.GetAppName()
+	}
+	return json.Marshal(sessionRecord{
+		CookieValue:  s.cookieValue,
+		Username:     s.username,
+		AppName:      appName,
+		IDToken:      s.idToken,
+		RefreshToken: s.refreshToken,
+		Expiry:       s.expiry,
+		Roles:        s.roles,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The result has a nil app, fwd,
+// and checker; sessionCache.get is responsible for rebuilding them.
+func (s *session) UnmarshalJSON(data []byte) error {
+	var rec sessionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	s.cookieValue = rec.CookieValue
+	s.username = rec.Username
+	s.appName = rec.AppName
+	s.idToken = rec.IDToken
+	s.refreshToken = rec.RefreshToken
+	s.expiry = rec.Expiry
+	s.roles = rec.Roles
+	return nil
+}
+
+// sessionCacheConfig configures a sessionCache.
+type sessionCacheConfig struct {
+	// AuthClient is used to look up applications and identities.
+	AuthClient auth.ClientI
+
+	// ProxyClient is used to reach applications across trusted clusters.
+	ProxyClient reversetunnel.Server
+
+	// Store persists sessions. Defaults to an in-process map.
+	Store SessionStore
+
+	// ProxyConfig controls how applications are dialed.
+	ProxyConfig ProxyConfig
+
+	// Apps resolves an application by name, used to re-hydrate a session
+	// read back from Store with the services.Server its appName refers to.
+	Apps *AppRegistry
+
+	// AuthProvider, if set, is used to silently renew a session minted from
+	// an external login once its ID token expires, instead of forcing the
+	// caller back through the browser redirect.
+	AuthProvider AuthProvider
+}
+
+// sessionCache mints and looks up sessions, persisting them through Store
+// so they survive across app proxy replicas.
+type sessionCache struct {
+	c sessionCacheConfig
+}
+
+// newSessionCache returns a sessionCache backed by cfg.Store (or an
+// in-process map if unset).
+func newSessionCache(cfg sessionCacheConfig) (*sessionCache, error) {
+	if cfg.Store == nil {
+		cfg.Store = newMemorySessionStore()
+	}
+	return &sessionCache{c: cfg}, nil
+}
+
+// get returns the session stored under cookieValue, extending its TTL. If
+// sess came back from a SessionStore that can't round-trip fwd/checker/app
+// (i.e. anything but the in-process default), they're rebuilt here.
+func (s *sessionCache) get(ctx context.Context, cookieValue string) (*session, error) {
+	sess, err := s.c.Store.Get(ctx, cookieValue)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := s.maybeRefresh(ctx, sess); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := s.hydrate(sess); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := s.c.Store.Touch(ctx, cookieValue, sessionTTL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return sess, nil
+}
+
+// maybeRefresh silently renews sess via AuthProvider.Refresh once its ID
+// token has expired, so a caller logged in through an external provider
+// isn't forced back through the browser redirect just because IDToken aged
+// out. Sessions with no expiry set (not minted from a login, or the
+// provider didn't report one) are left alone.
+func (s *sessionCache) maybeRefresh(ctx context.Context, sess *session) error {
+	if sess.expiry.IsZero() || time.Now().Before(sess.expiry) {
+		return nil
+	}
+	if s.c.AuthProvider == nil {
+		return trace.BadParameter("session for %v has expired and no AuthProvider is configured to refresh it", sess.username)
+	}
+
+	identity, err := s.c.AuthProvider.Refresh(ctx, sess.refreshToken)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	sess.idToken = identity.IDToken
+	sess.refreshToken = identity.RefreshToken
+	sess.expiry = identity.Expiry
+
+	return s.c.Store.Put(ctx, sess.cookieValue, sess, sessionTTL)
+}
+
+// hydrate fills in sess.app, sess.checker, and sess.fwd if they're missing,
+// which is the case for a session newSession has just minted (checker and
+// fwd) and after a round trip through a SessionStore that had to serialize
+// the session (the in-process default never does). It holds
+// sess.mu for its entire body so two goroutines that got the same *session
+// from a shared cache (see backendSessionStore) can't both observe a nil
+// field and write it at once.
+func (s *sessionCache) hydrate(sess *session) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.app == nil {
+		if s.c.Apps == nil {
+			return trace.BadParameter("session for %v has no app and no AppRegistry to resolve %v", sess.username, sess.appName)
+		}
+		_, app, err := s.c.Apps.Lookup(sess.appName)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		sess.app = app
+	}
+
+	if sess.checker == nil {
+		if len(sess.roles) == 0 {
+			sess.checker = denyAllChecker{}
+		} else {
+			checker, err := buildAccessChecker(sess.roles, s.c.AuthClient)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			sess.checker = checker
+		}
+	}
+
+	if sess.fwd == nil {
+		transport, err := s.c.ProxyConfig.transport(sess.app.GetProxyURL())
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		fwd, err := forward.New(forward.RoundTripper(transport))
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		sess.fwd = fwd
+	}
+
+	return nil
+}
+
+// newSession mints a session for username's access to app, persists it, and
+// returns it so the caller can set its cookie. identity is optional; when
+// set (a session minted from an AuthProvider login), its tokens are stored
+// so sessionCache.get can later silently refresh the session.
+func (s *sessionCache) newSession(ctx context.Context, username string, app services.Server, identity *Identity) (*session, error) {
+	cookieValue, err := newCookieValue()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sess := &session{
+		cookieValue: cookieValue,
+		username:    username,
+		app:         app,
+	}
+	if identity != nil {
+		sess.idToken = identity.IDToken
+		sess.refreshToken = identity.RefreshToken
+		sess.expiry = identity.Expiry
+		sess.roles = identity.Roles
+	}
+	if err := s.hydrate(sess); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := s.c.Store.Put(ctx, cookieValue, sess, sessionTTL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return sess, nil
+}
+
+// newCookieValue generates a fresh random session identifier.
+func newCookieValue() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// extractCookie pulls the session cookie out of r.
+func extractCookie(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if cookie.Value == "" {
+		return "", trace.BadParameter("cookie is missing a value")
+	}
+	return cookie.Value, nil
+}
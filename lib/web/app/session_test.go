@@ -0,0 +1,246 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+
+	"github.com/vulcand/oxy/forward"
+)
+
+// fakeAuthClient implements GetRole, the only auth.ClientI method
+// buildAccessChecker calls. It never has a role to return, which is enough
+// to prove hydrate reached buildAccessChecker at all rather than skipping
+// it.
+type fakeAuthClient struct{}
+
+func (fakeAuthClient) GetRole(name string) (services.Role, error) {
+	return nil, trace.NotFound("role %v not found", name)
+}
+
+// stubAuthProvider is a minimal AuthProvider for tests that don't need a
+// real OIDC discovery round trip.
+type stubAuthProvider struct {
+	refreshed    string
+	refreshErr   error
+	nextIdentity *Identity
+}
+
+func (p *stubAuthProvider) LoginURL(state string) (string, error) { return "", nil }
+
+func (p *stubAuthProvider) Exchange(ctx context.Context, state, code string) (*Identity, error) {
+	return nil, trace.BadParameter("Exchange not used in this test")
+}
+
+func (p *stubAuthProvider) Refresh(ctx context.Context, refreshToken string) (*Identity, error) {
+	p.refreshed = refreshToken
+	if p.refreshErr != nil {
+		return nil, p.refreshErr
+	}
+	return p.nextIdentity, nil
+}
+
+// TestSessionCacheMaybeRefreshExpired checks that a session whose ID token
+// has expired is silently renewed via AuthProvider.Refresh, and that the
+// renewed tokens are persisted back to the store.
+func TestSessionCacheMaybeRefreshExpired(t *testing.T) {
+	provider := &stubAuthProvider{
+		nextIdentity: &Identity{
+			Username:     "alice",
+			IDToken:      "new-id-token",
+			RefreshToken: "new-refresh-token",
+			Expiry:       time.Now().Add(time.Hour),
+		},
+	}
+
+	store := newMemorySessionStore()
+	cache, err := newSessionCache(sessionCacheConfig{Store: store, AuthProvider: provider})
+	if err != nil {
+		t.Fatalf("newSessionCache: %v", err)
+	}
+
+	sess := &session{
+		cookieValue:  "cookie-123",
+		username:     "alice",
+		idToken:      "old-id-token",
+		refreshToken: "old-refresh-token",
+		expiry:       time.Now().Add(-time.Minute),
+	}
+	if err := store.Put(context.Background(), sess.cookieValue, sess, sessionTTL); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := cache.maybeRefresh(context.Background(), sess); err != nil {
+		t.Fatalf("maybeRefresh: %v", err)
+	}
+
+	if provider.refreshed != "old-refresh-token" {
+		t.Errorf("Refresh called with %q, want %q", provider.refreshed, "old-refresh-token")
+	}
+	if sess.idToken != "new-id-token" {
+		t.Errorf("idToken = %q, want %q", sess.idToken, "new-id-token")
+	}
+	if sess.refreshToken != "new-refresh-token" {
+		t.Errorf("refreshToken = %q, want %q", sess.refreshToken, "new-refresh-token")
+	}
+
+	stored, err := store.Get(context.Background(), sess.cookieValue)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if stored.idToken != "new-id-token" {
+		t.Errorf("persisted idToken = %q, want %q", stored.idToken, "new-id-token")
+	}
+}
+
+// TestSessionCacheMaybeRefreshNotExpired checks that a session with no
+// expiry, or one still in the future, is left untouched.
+func TestSessionCacheMaybeRefreshNotExpired(t *testing.T) {
+	provider := &stubAuthProvider{}
+	cache, err := newSessionCache(sessionCacheConfig{AuthProvider: provider})
+	if err != nil {
+		t.Fatalf("newSessionCache: %v", err)
+	}
+
+	sess := &session{cookieValue: "cookie-123", refreshToken: "old-refresh-token"}
+	if err := cache.maybeRefresh(context.Background(), sess); err != nil {
+		t.Fatalf("maybeRefresh on zero-expiry session: %v", err)
+	}
+	if provider.refreshed != "" {
+		t.Errorf("Refresh called on a session with no expiry")
+	}
+
+	sess.expiry = time.Now().Add(time.Hour)
+	if err := cache.maybeRefresh(context.Background(), sess); err != nil {
+		t.Fatalf("maybeRefresh on future expiry: %v", err)
+	}
+	if provider.refreshed != "" {
+		t.Errorf("Refresh called on a session that hasn't expired yet")
+	}
+}
+
+// TestSessionCacheMaybeRefreshNoAuthProvider checks that an expired session
+// is rejected, rather than silently treated as valid, when no AuthProvider
+// is configured to renew it.
+func TestSessionCacheMaybeRefreshNoAuthProvider(t *testing.T) {
+	cache, err := newSessionCache(sessionCacheConfig{})
+	if err != nil {
+		t.Fatalf("newSessionCache: %v", err)
+	}
+
+	sess := &session{cookieValue: "cookie-123", expiry: time.Now().Add(-time.Minute)}
+	if err := cache.maybeRefresh(context.Background(), sess); err == nil {
+		t.Fatal("maybeRefresh on expired session with no AuthProvider succeeded, want error")
+	}
+}
+
+// TestHydrateDeniesAccessByDefaultWithNoRoles checks that a session whose
+// roles are empty gets a checker that denies access to every app, rather
+// than the old allowAllChecker fallback, which would grant a RoleMapper's
+// legitimate "no roles" result unrestricted access instead of none.
+func TestHydrateDeniesAccessByDefaultWithNoRoles(t *testing.T) {
+	cache, err := newSessionCache(sessionCacheConfig{})
+	if err != nil {
+		t.Fatalf("newSessionCache: %v", err)
+	}
+
+	fwd, err := forward.New()
+	if err != nil {
+		t.Fatalf("forward.New: %v", err)
+	}
+	app := fakeServer{appName: "dashboard"}
+	sess := &session{app: app, fwd: fwd}
+
+	if err := cache.hydrate(sess); err != nil {
+		t.Fatalf("hydrate: %v", err)
+	}
+
+	if err := sess.checker.CheckAccessToApp(app); err == nil {
+		t.Fatal("CheckAccessToApp with no roles succeeded, want access denied")
+	}
+}
+
+// TestHydrateBuildsCheckerFromRoles checks that a session with roles set
+// takes the RBAC path through buildAccessChecker instead of the no-roles
+// deny-all default, by observing that fakeAuthClient's role lookup failure
+// propagates as hydrate's error rather than being silently swallowed into
+// either allow or deny.
+func TestHydrateBuildsCheckerFromRoles(t *testing.T) {
+	cache, err := newSessionCache(sessionCacheConfig{AuthClient: fakeAuthClient{}})
+	if err != nil {
+		t.Fatalf("newSessionCache: %v", err)
+	}
+
+	fwd, err := forward.New()
+	if err != nil {
+		t.Fatalf("forward.New: %v", err)
+	}
+	sess := &session{
+		app:   fakeServer{appName: "dashboard"},
+		fwd:   fwd,
+		roles: []string{"app-access"},
+	}
+
+	err = cache.hydrate(sess)
+	if err == nil {
+		t.Fatal("hydrate with a role fakeAuthClient doesn't know about succeeded, want the lookup error to propagate")
+	}
+	if !trace.IsNotFound(err) {
+		t.Errorf("hydrate error = %v, want the not-found role lookup error, not the no-roles deny-all default", err)
+	}
+}
+
+// TestHydrateConcurrentSafe checks that two goroutines calling hydrate on
+// the same *session at once (what happens when two requests for the same
+// cookie both hit the same cache entry in backendSessionStore) don't race
+// on sess.app/checker/fwd. Run with -race to catch a regression here.
+func TestHydrateConcurrentSafe(t *testing.T) {
+	cache, err := newSessionCache(sessionCacheConfig{})
+	if err != nil {
+		t.Fatalf("newSessionCache: %v", err)
+	}
+
+	sess := &session{app: fakeServer{appName: "dashboard"}}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- cache.hydrate(sess)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("hydrate: %v", err)
+		}
+	}
+	if sess.checker == nil || sess.fwd == nil {
+		t.Fatal("hydrate left checker or fwd unset")
+	}
+}
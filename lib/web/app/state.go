@@ -0,0 +1,141 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// stateTTL is how long a state token minted by stateCache.new remains
+// valid. Logins that take longer than this to complete must be retried.
+const stateTTL = 5 * time.Minute
+
+// stateCache hands out single-use, expiring tokens used to bind an OIDC
+// login's callback back to the request that started it.
+type stateCache struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+// newStateCache returns an empty stateCache.
+func newStateCache() *stateCache {
+	return &stateCache{
+		tokens: make(map[string]time.Time),
+	}
+}
+
+// new mints and records a fresh state token.
+func (c *stateCache) new() string {
+	var buf [32]byte
+	rand.Read(buf[:])
+	token := hex.EncodeToString(buf[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLocked()
+	c.tokens[token] = time.Now().Add(stateTTL)
+	return token
+}
+
+// consume reports whether token is a valid, unexpired token, and removes it
+// so it cannot be replayed.
+func (c *stateCache) consume(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLocked()
+
+	expiry, ok := c.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(c.tokens, token)
+	return time.Now().Before(expiry)
+}
+
+// expireLocked drops expired tokens. The caller must hold c.mu.
+func (c *stateCache) expireLocked() {
+	now := time.Now()
+	for token, expiry := range c.tokens {
+		if now.After(expiry) {
+			delete(c.tokens, token)
+		}
+	}
+}
+
+// verifierCache is like stateCache, but holds a value (a PKCE code
+// verifier) alongside each state token instead of just tracking presence.
+type verifierCache struct {
+	mu      sync.Mutex
+	entries map[string]verifierEntry
+}
+
+type verifierEntry struct {
+	verifier string
+	expiry   time.Time
+}
+
+// newVerifierCache returns an empty verifierCache.
+func newVerifierCache() *verifierCache {
+	return &verifierCache{entries: make(map[string]verifierEntry)}
+}
+
+// add records verifier under state, valid for stateTTL.
+func (c *verifierCache) add(state, verifier string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLocked()
+	c.entries[state] = verifierEntry{verifier: verifier, expiry: time.Now().Add(stateTTL)}
+}
+
+// consume returns the verifier recorded under state, if any, and removes it
+// so it cannot be reused.
+func (c *verifierCache) consume(state string) (string, bool) {
+	if state == "" {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLocked()
+
+	entry, ok := c.entries[state]
+	if !ok {
+		return "", false
+	}
+	delete(c.entries, state)
+	if time.Now().After(entry.expiry) {
+		return "", false
+	}
+	return entry.verifier, true
+}
+
+// expireLocked drops expired entries. The caller must hold c.mu.
+func (c *verifierCache) expireLocked() {
+	now := time.Now()
+	for state, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, state)
+		}
+	}
+}
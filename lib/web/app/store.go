@@ -0,0 +1,274 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/backend"
+
+	"github.com/gravitational/trace"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// SessionStore is where sessionCache persists sessions, allowing the app
+// proxy to run as multiple replicas that all see the same logins. The
+// default, in-memory implementation only works for a single instance.
+type SessionStore interface {
+	// Get returns the session stored under id, or trace.NotFound if it
+	// does not exist or has expired.
+	Get(ctx context.Context, id string) (*session, error)
+
+	// Put stores s under id with the given TTL.
+	Put(ctx context.Context, id string, s *session, ttl time.Duration) error
+
+	// Delete removes the session stored under id.
+	Delete(ctx context.Context, id string) error
+
+	// Touch extends the TTL of the session stored under id.
+	Touch(ctx context.Context, id string, ttl time.Duration) error
+}
+
+// memorySessionStore is the default SessionStore: a single process' map.
+// It is what sessionCache historically used before SessionStore existed.
+type memorySessionStore struct {
+	mu sync.Mutex
+
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	session *session
+	expiry  time.Time
+}
+
+// newMemorySessionStore returns a SessionStore backed by an in-process map.
+func newMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+// Get implements SessionStore.
+func (m *memorySessionStore) Get(ctx context.Context, id string) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[id]
+	if !ok || time.Now().After(entry.expiry) {
+		return nil, trace.NotFound("session %v not found", id)
+	}
+	return entry.session, nil
+}
+
+// Put implements SessionStore.
+func (m *memorySessionStore) Put(ctx context.Context, id string, s *session, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[id] = memoryEntry{session: s, expiry: time.Now().Add(ttl)}
+	return nil
+}
+
+// Delete implements SessionStore.
+func (m *memorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, id)
+	return nil
+}
+
+// Touch implements SessionStore.
+func (m *memorySessionStore) Touch(ctx context.Context, id string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[id]
+	if !ok {
+		return trace.NotFound("session %v not found", id)
+	}
+	entry.expiry = time.Now().Add(ttl)
+	m.entries[id] = entry
+	return nil
+}
+
+// backendSessionBucket is the backend bucket sessions are written under,
+// shared by every app proxy replica.
+var backendSessionBucket = []string{"apps", "sessions"}
+
+// backendSessionStore persists sessions, AEAD-encrypted with a per-cluster
+// key, through auth.ClientI into the Teleport backend (etcd, DynamoDB,
+// Firestore, ...), so every replica of the app proxy observes the same
+// logins. A small LRU sits in front to keep the hit path off the backend.
+type backendSessionStore struct {
+	authClient auth.ClientI
+	aead       cipher.AEAD
+	cache      *lru.Cache
+}
+
+// cacheEntry is what backendSessionStore.cache stores. lru.Cache itself has
+// no notion of expiry, so the TTL passed to Put/Touch is tracked alongside
+// the session and checked on every Get.
+type cacheEntry struct {
+	session *session
+	expiry  time.Time
+}
+
+// backendSessionStoreConfig configures a backendSessionStore.
+type backendSessionStoreConfig struct {
+	// AuthClient is used to read and write the backend.
+	AuthClient auth.ClientI
+
+	// EncryptionKey is the per-cluster AEAD key used to encrypt sessions
+	// at rest. It must be 16, 24, or 32 bytes (AES-128/192/256).
+	EncryptionKey []byte
+
+	// CacheSize bounds the number of sessions kept in the local LRU.
+	CacheSize int
+}
+
+// newBackendSessionStore constructs a backendSessionStore from cfg.
+func newBackendSessionStore(cfg backendSessionStoreConfig) (SessionStore, error) {
+	block, err := aes.NewCipher(cfg.EncryptionKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	cacheSize := cfg.CacheSize
+	if cacheSize == 0 {
+		cacheSize = 1024
+	}
+	cache, err := lru.New(cacheSize)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &backendSessionStore{
+		authClient: cfg.AuthClient,
+		aead:       aead,
+		cache:      cache,
+	}, nil
+}
+
+// Get implements SessionStore.
+func (b *backendSessionStore) Get(ctx context.Context, id string) (*session, error) {
+	if v, ok := b.cache.Get(id); ok {
+		entry := v.(cacheEntry)
+		if time.Now().Before(entry.expiry) {
+			return entry.session, nil
+		}
+		b.cache.Remove(id)
+	}
+
+	item, err := b.authClient.GetItem(ctx, append(backendSessionBucket, id))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	s, err := b.decrypt(item.Value)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	b.cache.Add(id, cacheEntry{session: s, expiry: item.Expires})
+	return s, nil
+}
+
+// Put implements SessionStore.
+func (b *backendSessionStore) Put(ctx context.Context, id string, s *session, ttl time.Duration) error {
+	sealed, err := b.encrypt(s)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	expires := time.Now().Add(ttl)
+	err = b.authClient.UpsertItem(ctx, backend.Item{
+		Key:     append(backendSessionBucket, id),
+		Value:   sealed,
+		Expires: expires,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	b.cache.Add(id, cacheEntry{session: s, expiry: expires})
+	return nil
+}
+
+// Delete implements SessionStore.
+func (b *backendSessionStore) Delete(ctx context.Context, id string) error {
+	b.cache.Remove(id)
+	return trace.Wrap(b.authClient.DeleteItem(ctx, append(backendSessionBucket, id)))
+}
+
+// Touch implements SessionStore.
+func (b *backendSessionStore) Touch(ctx context.Context, id string, ttl time.Duration) error {
+	s, err := b.Get(ctx, id)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return b.Put(ctx, id, s, ttl)
+}
+
+// encrypt seals s with a random nonce prepended to the ciphertext.
+func (b *backendSessionStore) encrypt(s *session) ([]byte, error) {
+	plaintext, err := json.Marshal(s)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt reverses encrypt.
+func (b *backendSessionStore) decrypt(sealed []byte) (*session, error) {
+	nonceSize := b.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, trace.BadParameter("encrypted session is truncated")
+	}
+
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var s session
+	if err := json.Unmarshal(plaintext, &s); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/lib/backend"
+
+	"github.com/gravitational/trace"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+func newTestBackendSessionStore(t *testing.T) *backendSessionStore {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("failed to create AEAD: %v", err)
+	}
+	return &backendSessionStore{aead: aead}
+}
+
+// fakeItemStore implements the subset of auth.ClientI that
+// backendSessionStore calls (GetItem, UpsertItem, DeleteItem) over a plain
+// map, standing in for the Teleport backend. It deliberately doesn't expire
+// entries on its own: tests that care about TTL behavior drive it directly
+// so the expiry logic under test lives entirely in backendSessionStore, not
+// in this fake.
+type fakeItemStore struct {
+	mu    sync.Mutex
+	items map[string]backend.Item
+}
+
+func newFakeItemStore() *fakeItemStore {
+	return &fakeItemStore{items: make(map[string]backend.Item)}
+}
+
+func itemKey(key []string) string { return strings.Join(key, "/") }
+
+func (f *fakeItemStore) GetItem(ctx context.Context, key []string) (*backend.Item, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	item, ok := f.items[itemKey(key)]
+	if !ok {
+		return nil, trace.NotFound("item %v not found", itemKey(key))
+	}
+	return &item, nil
+}
+
+func (f *fakeItemStore) UpsertItem(ctx context.Context, item backend.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.items[itemKey(item.Key)] = item
+	return nil
+}
+
+func (f *fakeItemStore) DeleteItem(ctx context.Context, key []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.items, itemKey(key))
+	return nil
+}
+
+func (f *fakeItemStore) delete(key ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, itemKey(key))
+}
+
+// newTestBackendSessionStoreWithClient is like newTestBackendSessionStore
+// but also wires up authClient and the front-of-backend LRU, for tests that
+// drive Get/Put/Delete/Touch rather than just encrypt/decrypt.
+func newTestBackendSessionStoreWithClient(t *testing.T, authClient *fakeItemStore) *backendSessionStore {
+	store := newTestBackendSessionStore(t)
+	store.authClient = authClient
+	cache, err := lru.New(1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	store.cache = cache
+	return store
+}
+
+// TestBackendSessionStoreRoundTrip checks that encrypt followed by decrypt
+// recovers the fields of the original session that are expected to survive
+// the trip (fwd and checker aren't serializable, so they aren't compared).
+func TestBackendSessionStoreRoundTrip(t *testing.T) {
+	store := newTestBackendSessionStore(t)
+
+	original := &session{
+		cookieValue: "cookie-123",
+		username:    "alice",
+		appName:     "dashboard",
+	}
+
+	sealed, err := store.encrypt(original)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	recovered, err := store.decrypt(sealed)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+
+	if recovered.cookieValue != original.cookieValue {
+		t.Errorf("cookieValue = %q, want %q", recovered.cookieValue, original.cookieValue)
+	}
+	if recovered.username != original.username {
+		t.Errorf("username = %q, want %q", recovered.username, original.username)
+	}
+	if recovered.appName != original.appName {
+		t.Errorf("appName = %q, want %q", recovered.appName, original.appName)
+	}
+}
+
+// TestBackendSessionStoreTamperedCiphertext checks that a flipped ciphertext
+// byte is rejected by AEAD authentication rather than silently decrypted.
+func TestBackendSessionStoreTamperedCiphertext(t *testing.T) {
+	store := newTestBackendSessionStore(t)
+
+	sealed, err := store.encrypt(&session{cookieValue: "cookie-123", username: "alice"})
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	sealed[len(sealed)-1] ^= 0xFF
+
+	if _, err := store.decrypt(sealed); err == nil {
+		t.Fatal("decrypt of tampered ciphertext succeeded, want error")
+	}
+}
+
+// TestBackendSessionStoreGetPutDelete checks that a session put through
+// Get/Put/Delete round-trips its fields and that Delete actually removes it,
+// from the backend and not just the front LRU.
+func TestBackendSessionStoreGetPutDelete(t *testing.T) {
+	client := newFakeItemStore()
+	store := newTestBackendSessionStoreWithClient(t, client)
+	ctx := context.Background()
+
+	original := &session{cookieValue: "cookie-123", username: "alice", appName: "dashboard"}
+	if err := store.Put(ctx, original.cookieValue, original, time.Hour); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	got, err := store.Get(ctx, original.cookieValue)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.username != original.username {
+		t.Errorf("username = %q, want %q", got.username, original.username)
+	}
+
+	if err := store.Delete(ctx, original.cookieValue); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, original.cookieValue); !trace.IsNotFound(err) {
+		t.Errorf("Get after Delete = %v, want NotFound", err)
+	}
+}
+
+// TestBackendSessionStoreTouchExtendsTTL checks that Touch persists a new
+// expiry to the backend, not just to the front cache.
+func TestBackendSessionStoreTouchExtendsTTL(t *testing.T) {
+	client := newFakeItemStore()
+	store := newTestBackendSessionStoreWithClient(t, client)
+	ctx := context.Background()
+
+	sess := &session{cookieValue: "cookie-123", username: "alice"}
+	if err := store.Put(ctx, sess.cookieValue, sess, time.Minute); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := store.Touch(ctx, sess.cookieValue, time.Hour); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+
+	item, err := client.GetItem(ctx, append(backendSessionBucket, sess.cookieValue))
+	if err != nil {
+		t.Fatalf("GetItem: %v", err)
+	}
+	if time.Until(item.Expires) <= time.Minute {
+		t.Errorf("backend expiry wasn't extended by Touch: expires in %v", time.Until(item.Expires))
+	}
+}
+
+// TestBackendSessionStoreCacheHonorsTTL checks that a cache hit past the TTL
+// passed to Put isn't served stale: once it's expired, Get must go back to
+// the backend instead of returning the cached entry forever. Prior to this,
+// backendSessionStore.cache never recorded an expiry at all, so Put/Touch's
+// ttl argument had no effect on the cache's hit path.
+func TestBackendSessionStoreCacheHonorsTTL(t *testing.T) {
+	client := newFakeItemStore()
+	store := newTestBackendSessionStoreWithClient(t, client)
+	ctx := context.Background()
+
+	sess := &session{cookieValue: "cookie-123", username: "alice"}
+	if err := store.Put(ctx, sess.cookieValue, sess, 20*time.Millisecond); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if _, err := store.Get(ctx, sess.cookieValue); err != nil {
+		t.Fatalf("Get before expiry: %v", err)
+	}
+
+	// Remove the backend-side copy directly so a Get that's still (wrongly)
+	// served from the cache is distinguishable from one that correctly fell
+	// through to the backend.
+	client.delete(append(backendSessionBucket, sess.cookieValue)...)
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := store.Get(ctx, sess.cookieValue); !trace.IsNotFound(err) {
+		t.Errorf("Get after TTL elapsed = %v, want NotFound (cache served an expired entry)", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Package revocation stores and retrieves revoked SSH certificate serials
+// and key IDs in a Teleport backend. It exists as its own package so that
+// auth (which writes a revocation when an operator revokes a cert) and srv
+// (which reads revocations back to reject them in the public-key callback)
+// can share the storage format without auth importing srv or vice versa.
+package revocation
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gravitational/teleport/backend"
+)
+
+// BackendBucket is the backend bucket revoked certificates are stored
+// under.
+var BackendBucket = []string{"krl"}
+
+// DefaultKey is the backend key auth.AuthServer.RevokeUserCert writes
+// revocations under. A srv.Server picks up those revocations by setting
+// KRLConfig.Backend to this same value; a deployment that wants more than
+// one independently-revocable set of certificates can still use a
+// different key directly with Revoke.
+const DefaultKey = "default"
+
+// Set is the on-backend representation of revoked certificates. It
+// intentionally isn't the OpenSSH KRL wire format: it is only ever read
+// back through Revoke/Read, so a plain JSON list is simpler to append to
+// atomically than a binary KRL would be.
+type Set struct {
+	Serials []uint64 `json:"serials"`
+	KeyIDs  []string `json:"key_ids"`
+}
+
+// maxRevokeAttempts bounds how many times Revoke retries its
+// compare-and-swap loop before giving up. Each retry only happens because
+// another Revoke call won the race in between, so this many collisions in a
+// row means contention far beyond anything a batch revocation should cause.
+const maxRevokeAttempts = 10
+
+// Revoke appends serial/keyID to the revocation set stored under key in bk.
+//
+// This is a compare-and-swap loop rather than a plain read-modify-write:
+// two Revoke calls racing on the same key (an operator revoking several
+// certs at once, or two independent callers) must not let the second
+// writer's UpsertVal silently discard the first writer's append. Each
+// iteration reads the current raw value, appends to the set it decodes to,
+// and swaps only if the backend's value hasn't changed since the read;
+// a concurrent writer landing in between fails the swap and is retried
+// against whatever is there now instead of overwriting it.
+func Revoke(bk backend.Backend, key string, serial uint64, keyID string) error {
+	for attempt := 0; attempt < maxRevokeAttempts; attempt++ {
+		prev, err := bk.GetVal(BackendBucket, key)
+		notFound := backend.IsNotFound(err)
+		if err != nil && !notFound {
+			return fmt.Errorf("failed to read revocation set %q: %v", key, err)
+		}
+		if notFound {
+			prev = nil
+		}
+
+		var set Set
+		if !notFound {
+			if jerr := json.Unmarshal(prev, &set); jerr != nil {
+				return fmt.Errorf("failed to parse revocation set %q: %v", key, jerr)
+			}
+		}
+		set.Serials = append(set.Serials, serial)
+		set.KeyIDs = append(set.KeyIDs, keyID)
+
+		out, err := json.Marshal(set)
+		if err != nil {
+			return fmt.Errorf("failed to encode revocation set %q: %v", key, err)
+		}
+
+		_, err = bk.CompareAndSwap(BackendBucket, key, out, 0, prev)
+		switch {
+		case err == nil:
+			return nil
+		case backend.IsCompareFailed(err):
+			continue
+		default:
+			return fmt.Errorf("failed to write revocation set %q: %v", key, err)
+		}
+	}
+	return fmt.Errorf("failed to append to revocation set %q after %d attempts: too much concurrent contention", key, maxRevokeAttempts)
+}
+
+// Read fetches and parses the revocation set stored under key in bk. A
+// not-found key isn't an error: it means nothing has been revoked yet.
+func Read(bk backend.Backend, key string) (Set, error) {
+	var set Set
+
+	data, err := bk.GetVal(BackendBucket, key)
+	switch {
+	case err == nil:
+		if jerr := json.Unmarshal(data, &set); jerr != nil {
+			return set, fmt.Errorf("failed to parse revocation set %q: %v", key, jerr)
+		}
+	case backend.IsNotFound(err):
+		// No revocations recorded yet.
+	default:
+		return set, fmt.Errorf("failed to read revocation set %q: %v", key, err)
+	}
+	return set, nil
+}
@@ -0,0 +1,176 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/gravitational/teleport/backend"
+)
+
+// Config configures a Server.
+type Config struct {
+	// Addr is the address the server listens for SSH connections on.
+	Addr string
+
+	// HostCert is this server's host certificate, signed by the host CA.
+	HostCert []byte
+
+	// HostKey is the private key matching HostCert.
+	HostKey []byte
+
+	// UserCAs are the public keys of the user certificate authorities
+	// trusted to sign certificates presented by SSH clients. A certificate
+	// whose signing key isn't one of these is rejected outright, before
+	// revocation is even checked.
+	UserCAs []ssh.PublicKey
+
+	// Backend is where sessions, revocations, and other server state are
+	// persisted.
+	Backend backend.Backend
+
+	// Shell is the path to the shell spawned for interactive sessions.
+	Shell string
+
+	// KRL configures certificate revocation checking. The zero value
+	// disables it.
+	KRL KRLConfig
+}
+
+// Server accepts SSH connections, authenticating callers by certificate and
+// rejecting any whose certificate has been revoked.
+type Server struct {
+	cfg Config
+
+	l         net.Listener
+	sshConfig *ssh.ServerConfig
+
+	certChecker *ssh.CertChecker
+	revocation  *revocationList
+
+	closeOnce sync.Once
+}
+
+// New creates a Server listening on cfg.Addr. Call Start to begin accepting
+// connections.
+func New(cfg Config) (*Server, error) {
+	hostSigner, err := ssh.ParsePrivateKey(cfg.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %v", err)
+	}
+
+	revocation, err := newRevocationList(cfg.KRL, cfg.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load KRL: %v", err)
+	}
+
+	s := &Server{
+		cfg:        cfg,
+		revocation: revocation,
+	}
+	s.certChecker = &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, ca := range cfg.UserCAs {
+				if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	sshConfig.AddHostKey(hostSigner)
+	s.sshConfig = sshConfig
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q: %v", cfg.Addr, err)
+	}
+	s.l = l
+
+	return s, nil
+}
+
+// checkPublicKey is the server's ssh.ServerConfig.PublicKeyCallback. It
+// verifies that the presented certificate is a user certificate signed by
+// one of cfg.UserCAs, with a validity window and principal list that admit
+// conn.User(), before checking that the KRL subsystem hasn't revoked it.
+func (s *Server) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	perms, err := s.certChecker.Authenticate(conn, key)
+	if err != nil {
+		return nil, fmt.Errorf("access denied for %q: %v", conn.User(), err)
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("access denied: %q presented a raw key, not a certificate", conn.User())
+	}
+
+	if err := s.revocation.checkNotRevoked(cert); err != nil {
+		return nil, fmt.Errorf("access denied for %q: %v", conn.User(), err)
+	}
+
+	return perms, nil
+}
+
+// Start begins accepting connections in the background.
+func (s *Server) Start() error {
+	go s.acceptLoop()
+	return nil
+}
+
+// acceptLoop accepts and handshakes connections until the listener closes.
+func (s *Server) acceptLoop() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn completes the SSH handshake for conn and then services its
+// channels. "session" channels (exec, shell, PTY, subsystems) are handled by
+// handleSessionChannel in session.go; every other channel type is rejected.
+func (s *Server) handleConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		go s.handleSessionChannel(sconn, newChannel)
+	}
+}
+
+// ReloadKRL forces an immediate reload of the configured KRL sources rather
+// than waiting for the next poll. It exists so a SIGHUP-style admin command
+// (or a test) can make a revocation take effect without waiting out
+// krlPollInterval.
+func (s *Server) ReloadKRL() error {
+	return s.revocation.reload()
+}
+
+// Close stops accepting new connections and tears down the KRL poller
+// started for cfg.KRL/cfg.Backend, if any.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.l.Close()
+		s.revocation.close()
+	})
+	return err
+}
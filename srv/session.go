@@ -0,0 +1,247 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh/agent"
+)
+
+// session tracks the state of a single "session" channel: the user it
+// belongs to, the channel itself, and (once requested) the agent forwarded
+// over the connection, which mux/tun subsystems use to authenticate to
+// another address as this same user.
+type session struct {
+	conn ssh.Conn
+	ch   ssh.Channel
+	user string
+	srv  *Server
+
+	agentClient agent.Agent
+}
+
+// handleSessionChannel accepts a "session" channel and services exec,
+// shell, pty-req, env, subsystem, and agent forwarding requests on it until
+// the channel closes.
+func (s *Server) handleSessionChannel(conn ssh.Conn, newChannel ssh.NewChannel) {
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	sess := &session{conn: conn, ch: ch, user: conn.User(), srv: s}
+	for req := range reqs {
+		sess.handleRequest(req)
+	}
+}
+
+type execMsg struct {
+	Command string
+}
+
+type subsystemMsg struct {
+	Subsystem string
+}
+
+// handleRequest services a single channel request. Unrecognized request
+// types are rejected; everything else replies true immediately (as the ssh
+// spec requires for "want reply" requests) before doing any of the
+// potentially slow work in the background.
+func (sess *session) handleRequest(req *ssh.Request) {
+	switch req.Type {
+	case "exec":
+		var m execMsg
+		if err := ssh.Unmarshal(req.Payload, &m); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		go sess.runExec(m.Command)
+
+	case "shell":
+		req.Reply(true, nil)
+		go sess.runShell()
+
+	case "pty-req":
+		// No real PTY is allocated; this only acknowledges the request so
+		// callers that ask for one (but don't depend on its effects) aren't
+		// refused outright.
+		req.Reply(true, nil)
+
+	case "env":
+		// Environment variables requested for the session are ignored.
+		req.Reply(true, nil)
+
+	case "subsystem":
+		var m subsystemMsg
+		if err := ssh.Unmarshal(req.Payload, &m); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		go sess.runSubsystem(m.Subsystem)
+
+	case "auth-agent-req@openssh.com":
+		req.Reply(true, nil)
+		sess.setupAgentForwarding()
+
+	default:
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// runExec runs command in s.srv.cfg.Shell and copies its output back over
+// the channel, then reports its exit status.
+func (sess *session) runExec(command string) {
+	defer sess.ch.Close()
+
+	cmd := exec.Command(sess.srv.cfg.Shell, "-c", command)
+	cmd.Stdin = sess.ch
+	cmd.Stdout = sess.ch
+	cmd.Stderr = sess.ch.Stderr()
+
+	sess.sendExitStatus(cmd.Run())
+}
+
+// runShell runs s.srv.cfg.Shell itself, wired directly to the channel, so
+// the caller can drive it like an interactive session.
+func (sess *session) runShell() {
+	defer sess.ch.Close()
+
+	cmd := exec.Command(sess.srv.cfg.Shell)
+	cmd.Stdin = sess.ch
+	cmd.Stdout = sess.ch
+	cmd.Stderr = sess.ch.Stderr()
+
+	sess.sendExitStatus(cmd.Run())
+}
+
+// sendExitStatus reports runErr (from exec.Cmd.Run) to the client as an
+// "exit-status" channel request, the way a real shell/exec channel closes.
+func (sess *session) sendExitStatus(runErr error) {
+	code := 0
+	if exitErr, ok := runErr.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if runErr != nil {
+		code = 1
+	}
+	sess.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+}
+
+// runSubsystem dispatches the two subsystems this server understands:
+// "mux:addr/command", which runs command on addr and streams its output
+// back, and "tun:addr", which wires an interactive shell on addr directly
+// to the channel. Both re-authenticate to addr as sess.user using the
+// client's forwarded agent.
+func (sess *session) runSubsystem(subsystem string) {
+	switch {
+	case strings.HasPrefix(subsystem, "mux:"):
+		rest := subsystem[len("mux:"):]
+		parts := strings.SplitN(rest, "/", 2)
+		if len(parts) != 2 {
+			sess.ch.Close()
+			return
+		}
+		sess.runMux(parts[0], parts[1])
+
+	case strings.HasPrefix(subsystem, "tun:"):
+		sess.runTun(subsystem[len("tun:"):])
+
+	default:
+		sess.ch.Close()
+	}
+}
+
+// dialAsUser opens an SSH connection to addr, authenticating as sess.user
+// via the agent forwarded over this session's connection.
+func (sess *session) dialAsUser(addr string) (*ssh.Client, error) {
+	if sess.agentClient == nil {
+		return nil, fmt.Errorf("no agent was forwarded for this session")
+	}
+	config := &ssh.ClientConfig{
+		User: sess.user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(sess.agentClient.Signers)},
+	}
+	return ssh.Dial("tcp", addr, config)
+}
+
+// runMux runs command on addr and copies its combined output back over the
+// channel.
+func (sess *session) runMux(addr, command string) {
+	defer sess.ch.Close()
+
+	client, err := sess.dialAsUser(addr)
+	if err != nil {
+		fmt.Fprintf(sess.ch.Stderr(), "mux: %v\n", err)
+		sess.sendExitStatus(err)
+		return
+	}
+	defer client.Close()
+
+	remoteSession, err := client.NewSession()
+	if err != nil {
+		fmt.Fprintf(sess.ch.Stderr(), "mux: %v\n", err)
+		sess.sendExitStatus(err)
+		return
+	}
+	defer remoteSession.Close()
+
+	out, err := remoteSession.Output(command)
+	sess.ch.Write(out)
+	sess.sendExitStatus(err)
+}
+
+// runTun opens an interactive shell on addr and copies bytes between it and
+// the channel in both directions until either side closes.
+func (sess *session) runTun(addr string) {
+	defer sess.ch.Close()
+
+	client, err := sess.dialAsUser(addr)
+	if err != nil {
+		fmt.Fprintf(sess.ch.Stderr(), "tun: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	remoteSession, err := client.NewSession()
+	if err != nil {
+		fmt.Fprintf(sess.ch.Stderr(), "tun: %v\n", err)
+		return
+	}
+	defer remoteSession.Close()
+
+	stdin, err := remoteSession.StdinPipe()
+	if err != nil {
+		return
+	}
+	stdout, err := remoteSession.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err := remoteSession.Shell(); err != nil {
+		return
+	}
+
+	go io.Copy(stdin, sess.ch)
+	io.Copy(sess.ch, stdout)
+	remoteSession.Wait()
+}
+
+// setupAgentForwarding opens the "auth-agent@openssh.com" channel back to
+// the client that agent.ForwardToAgent registered a handler for, giving
+// this session an agent.Agent it can use to authenticate as sess.user to
+// another address (see dialAsUser).
+func (sess *session) setupAgentForwarding() {
+	channel, reqs, err := sess.conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	sess.agentClient = agent.NewClient(channel)
+}
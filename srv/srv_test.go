@@ -2,11 +2,14 @@ package srv
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh"
 	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh/agent"
@@ -47,10 +50,19 @@ func (s *SrvSuite) SetUpTest(c *C) {
 	// set up user CA and set up a user that has access to the server
 	c.Assert(s.a.ResetUserCA(""), IsNil)
 
+	// set up SSH client using the user private key for signing. This has
+	// to happen before New(cfg) below: up.pcert.SignatureKey is the user
+	// CA's public key, which cfg.UserCAs needs in order to trust certs
+	// this CA issues.
+	up, err := newUpack("test", s.a)
+	c.Assert(err, IsNil)
+	s.up = up
+
 	cfg := Config{
 		Addr:     "localhost:0",
 		HostCert: hcert,
 		HostKey:  hpriv,
+		UserCAs:  []ssh.PublicKey{up.pcert.SignatureKey},
 		Backend:  s.bk,
 		Shell:    "/bin/sh",
 	}
@@ -60,14 +72,9 @@ func (s *SrvSuite) SetUpTest(c *C) {
 
 	c.Assert(s.srv.Start(), IsNil)
 
-	// set up SSH client using the user private key for signing
-	up, err := newUpack("test", s.a)
-	c.Assert(err, IsNil)
-
 	// set up an agent server and a client that uses agent for forwarding
 	keyring := agent.NewKeyring()
 	c.Assert(keyring.Add(up.pkey, up.pcert, ""), IsNil)
-	s.up = up
 
 	sshConfig := &ssh.ClientConfig{
 		User: "test",
@@ -178,6 +185,98 @@ func (s *SrvSuite) TestEnv(c *C) {
 	c.Assert(se.Setenv("HOME", "/"), IsNil)
 }
 
+// TestRevocationDisabled checks that no certificates are rejected when no
+// KRL has been configured for the server.
+func (s *SrvSuite) TestRevocationDisabled(c *C) {
+	r, err := newRevocationList(KRLConfig{}, s.bk)
+	c.Assert(err, IsNil)
+	c.Assert(r.IsRevoked(s.up.pcert), Equals, false)
+	c.Assert(r.checkNotRevoked(s.up.pcert), IsNil)
+}
+
+// TestRevokedCertRejected revokes a certificate that was previously able to
+// authenticate and asserts that the next ssh.Dial using it is refused.
+func (s *SrvSuite) TestRevokedCertRejected(c *C) {
+	hpriv, hpub, err := s.a.GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	hcert, err := s.a.GenerateHostCert(hpub, "localhost", "localhost", 0)
+	c.Assert(err, IsNil)
+
+	cfg := Config{
+		Addr:     "localhost:0",
+		HostCert: hcert,
+		HostKey:  hpriv,
+		UserCAs:  []ssh.PublicKey{s.up.pcert.SignatureKey},
+		Backend:  s.bk,
+		Shell:    "/bin/sh",
+		KRL:      KRLConfig{Backend: DefaultKRLBackendKey},
+	}
+	revokingSrv, err := New(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(revokingSrv.Start(), IsNil)
+	defer revokingSrv.Close()
+
+	sshConfig := &ssh.ClientConfig{
+		User: "test",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(s.up.certSigner)},
+	}
+
+	// The certificate is not yet revoked, so the dial succeeds.
+	clt, err := ssh.Dial("tcp", revokingSrv.l.Addr().String(), sshConfig)
+	c.Assert(err, IsNil)
+	c.Assert(clt.Close(), IsNil)
+
+	// Revoke it through the auth API (the same path a CLI/RPC revocation
+	// command would use) and force the server to pick up the change
+	// immediately.
+	c.Assert(s.a.RevokeUserCert(s.up.pcert.Serial, s.up.pcert.KeyId), IsNil)
+	c.Assert(revokingSrv.ReloadKRL(), IsNil)
+
+	// The same certificate must now be refused.
+	_, err = ssh.Dial("tcp", revokingSrv.l.Addr().String(), sshConfig)
+	c.Assert(err, NotNil)
+}
+
+// TestUntrustedCertRejected mints a throwaway CA and self-signs a
+// certificate for "test" with it instead of going through s.a's user CA,
+// and asserts that s.srv — which only trusts s.a's user CA — refuses it.
+// Without a CA-trust check in checkPublicKey, any caller minting their own
+// certificate like this would authenticate as whoever they like.
+func (s *SrvSuite) TestUntrustedCertRejected(c *C) {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	caSigner, err := ssh.NewSignerFromSigner(caPriv)
+	c.Assert(err, IsNil)
+
+	userPub, userPriv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	userSigner, err := ssh.NewSignerFromSigner(userPriv)
+	c.Assert(err, IsNil)
+	sshUserPub, err := ssh.NewPublicKey(userPub)
+	c.Assert(err, IsNil)
+
+	cert := &ssh.Certificate{
+		Key:             sshUserPub,
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"test"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	c.Assert(cert.SignCert(rand.Reader, caSigner), IsNil)
+
+	certSigner, err := ssh.NewCertSigner(cert, userSigner)
+	c.Assert(err, IsNil)
+
+	sshConfig := &ssh.ClientConfig{
+		User: "test",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+	}
+	_, err = ssh.Dial("tcp", s.srv.l.Addr().String(), sshConfig)
+	c.Assert(err, NotNil)
+}
+
 // TestNoAuth tries to log in with no auth methods and should be rejected
 func (s *SrvSuite) TestNoAuth(c *C) {
 	_, err := ssh.Dial("tcp", s.srv.l.Addr().String(), &ssh.ClientConfig{})
@@ -0,0 +1,65 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package common holds tctl subcommand implementations, following the
+// Initialize/TryRun pattern every tctl command uses so main.go can wire
+// them together without each one knowing about the others.
+package common
+
+import (
+	"fmt"
+
+	"github.com/gravitational/teleport/auth"
+
+	"github.com/gravitational/trace"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// RevokeCertCommand implements "tctl certs revoke", giving an operator a
+// way to call auth.AuthServer.RevokeUserCert from the command line instead
+// of writing Go against AuthServer directly.
+type RevokeCertCommand struct {
+	serial uint64
+	keyID  string
+
+	revokeCmd *kingpin.CmdClause
+}
+
+// Initialize registers the "certs revoke" command and its flags under
+// certs, the parent clause the rest of tctl's certificate-related commands
+// live under.
+func (c *RevokeCertCommand) Initialize(certs *kingpin.CmdClause) {
+	c.revokeCmd = certs.Command("revoke", "Revoke a previously issued user certificate.")
+	c.revokeCmd.Flag("serial", "Serial number of the certificate to revoke.").Required().Uint64Var(&c.serial)
+	c.revokeCmd.Flag("key-id", "Key ID of the certificate to revoke.").Required().StringVar(&c.keyID)
+}
+
+// TryRun executes this command if selectedCommand is the one Initialize
+// registered, reporting back whether it matched so main.go's dispatch loop
+// can move on to the next command if not.
+func (c *RevokeCertCommand) TryRun(selectedCommand string, client *auth.AuthServer) (match bool, err error) {
+	if selectedCommand != c.revokeCmd.FullCommand() {
+		return false, nil
+	}
+
+	if err := client.RevokeUserCert(c.serial, c.keyID); err != nil {
+		return true, trace.Wrap(err)
+	}
+
+	fmt.Printf("Certificate (serial=%d, key-id=%s) has been revoked.\n", c.serial, c.keyID)
+	return true, nil
+}